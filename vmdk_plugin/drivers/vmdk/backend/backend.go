@@ -0,0 +1,100 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend lets the vmdk driver route a volume's operations to any
+// storage backend registered here, instead of always talking to
+// vmdkops.VmdkOps directly. The driver itself registers only the default
+// block VMDK backend (see NewVolumeDriver). A volume picks its
+// backend at Create time via the "backend=" option and the driver
+// remembers the choice for later Mount/Remove/List calls.
+package backend
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultName is the backend used when a volume's Create request does not
+// specify one, preserving the original VMDK-only behavior.
+const DefaultName = "vmdk"
+
+// VolumeInfo is the per-volume summary returned by Ops.List.
+type VolumeInfo struct {
+	Name string
+}
+
+// Ops is the set of operations a storage backend must provide; it is the
+// same shape vmdkops.VmdkOps already exposes, generalized so other backends
+// can sit next to it in the registry.
+type Ops interface {
+	Create(name string, opts map[string]string) error
+	Remove(name string, opts map[string]string) error
+	List() ([]VolumeInfo, error)
+	Get(name string) (map[string]interface{}, error)
+	Attach(name string, opts map[string]string) ([]byte, error)
+	Detach(name string, opts map[string]string) error
+}
+
+// Factory builds the Ops instance for a backend. Factories are expected to
+// return the same (possibly connection-pooling) instance on every call
+// rather than constructing a fresh one per volume.
+type Factory func() Ops
+
+var (
+	mtx       sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a backend available under name. Called from each
+// backend's own package init(), or - for the default VMDK backend, whose
+// construction depends on runtime flags - from NewVolumeDriver.
+func Register(name string, factory Factory) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	factories[name] = factory
+}
+
+// New constructs the Ops instance registered under name.
+func New(name string) (Ops, error) {
+	mtx.Lock()
+	factory, ok := factories[name]
+	mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown volume backend %q", name)
+	}
+	return factory(), nil
+}
+
+// Exists reports whether a backend is registered under name, so callers
+// that must reject an unknown name outright (rather than silently
+// substituting a default, the way backendFor's cache lookup does for
+// already-created volumes) can check before acting on it.
+func Exists(name string) bool {
+	mtx.Lock()
+	defer mtx.Unlock()
+	_, ok := factories[name]
+	return ok
+}
+
+// Names returns the names of every registered backend.
+func Names() []string {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	return names
+}
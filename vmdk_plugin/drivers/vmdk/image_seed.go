@@ -0,0 +1,157 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Seeds a freshly created, empty volume with whatever content the Docker
+// image already has at the volume's bind-mount destination - the same
+// convenience the local volume driver provides for named volumes. Without
+// this, `docker run -v myvol:/etc/nginx nginx` masks the image's
+// /etc/nginx with an empty mount instead of seeding it.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyImageDataOption is the Create() option that opts a volume into being
+// seeded from the image path on its first mount.
+const copyImageDataOption = "copy-image-data"
+
+// wantsImageSeed reports whether status (as returned by ops.Get) asked for
+// the image path content to be copied into the volume on first mount.
+func wantsImageSeed(status map[string]interface{}) bool {
+	switch v := status[copyImageDataOption].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
+
+// seedFromImage copies whatever content the image rootfs has at the
+// volume's bind-mount destination into mountpoint, provided mountpoint is
+// currently empty. containerID is the container whose Mount caused this
+// volume to be attached for the first time.
+//
+// Docker calls VolumeDriver.Mount while it is still assembling the
+// container's mounts, before the container's init process is started -
+// there is no PID yet, so /proc/<pid>/root is not an option. The
+// already-assembled (merged) view of the image's layers is available at
+// that point, though, via the graphdriver data reported by `docker
+// inspect`, so that is used to reach the image content instead.
+//
+// Errors are non-fatal to the caller: failing to seed a volume should not
+// fail the mount, it should just leave the volume empty as before.
+func seedFromImage(containerID, volName, mountpoint string) error {
+	if containerID == "" {
+		return nil
+	}
+
+	empty, err := dirEmpty(mountpoint)
+	if err != nil || !empty {
+		return err
+	}
+
+	destPath, err := containerVolumeDestination(containerID, volName)
+	if err != nil || destPath == "" {
+		return err
+	}
+
+	rootfs, err := containerRootfs(containerID)
+	if err != nil {
+		return err
+	}
+
+	srcPath := filepath.Join(rootfs, destPath)
+	log.WithFields(log.Fields{
+		"name": volName,
+		"src":  srcPath,
+		"dst":  mountpoint,
+	}).Info("Seeding new volume with image content")
+
+	return exec.Command("cp", "-a", srcPath+"/.", mountpoint).Run()
+}
+
+// dirEmpty reports whether dir contains no entries.
+func dirEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// containerRootfs asks the Docker Engine for the merged view of
+// containerID's image layers - the graphdriver's MergedDir - which Docker
+// assembles as part of container creation, well before the container's
+// init process (and therefore its PID/mount namespace) exists.
+func containerRootfs(containerID string) (string, error) {
+	out, err := exec.Command(
+		"docker", "inspect", "-f", "{{.GraphDriver.Data.MergedDir}}", containerID).Output()
+	if err != nil {
+		return "", err
+	}
+	rootfs := strings.TrimSpace(string(out))
+	if rootfs == "" {
+		return "", fmt.Errorf("no graphdriver rootfs reported for container %s", containerID)
+	}
+	return rootfs, nil
+}
+
+// containerVolumeDestination asks the Docker Engine where volName is
+// bind-mounted inside containerID, so the image content already sitting
+// there can be located and copied into the freshly created volume.
+func containerVolumeDestination(containerID, volName string) (string, error) {
+	out, err := exec.Command("docker", "inspect", containerID).Output()
+	if err != nil {
+		return "", err
+	}
+
+	var containers []struct {
+		Mounts []struct {
+			Name        string
+			Destination string
+		}
+	}
+	if err := json.Unmarshal(out, &containers); err != nil {
+		return "", err
+	}
+
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Name == volName {
+				return m.Destination, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// refCounts starts empty on every plugin restart, so a crash leaves the
+// driver's view of which volumes are attached/mounted diverged from what
+// is actually attached to this VM and mounted in the guest: later Unmount
+// calls underflow, and volumes can be left attached to a VM that Docker
+// thinks is idle.
+//
+// Recover rebuilds refCounts by asking the local Docker Engine which
+// running containers actually reference each volume, then reconciles
+// filesystem state to match: unmounting/detaching orphans and re-mounting
+// volumes a container expects mounted but that aren't.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+// dockerSock is the local Docker Engine's Unix socket.
+const dockerSock = "/var/run/docker.sock"
+
+var dockerEngine = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", dockerSock)
+		},
+	},
+	Timeout: 5 * time.Second,
+}
+
+// containersUsingVolumeFn and isMountedFn are swapped out in tests so
+// recoverVolume's reconciliation logic can be exercised without a real
+// Docker Engine or real mounts.
+var (
+	containersUsingVolumeFn = containersUsingVolume
+	isMountedFn             = isMounted
+)
+
+// containersUsingVolume returns the IDs of the running containers the local
+// Docker Engine currently reports as referencing volName, via
+// GET /containers/json?filters={"volume":[...]}.
+func containersUsingVolume(volName string) ([]string, error) {
+	filters := fmt.Sprintf(`{"volume":["%s"]}`, volName)
+	reqURL := "http://unix/containers/json?filters=" + url.QueryEscape(filters)
+
+	resp, err := dockerEngine.Get(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+// isMounted reports whether path appears as a mountpoint in /proc/mounts.
+func isMounted(path string) bool {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Recover rebuilds refCounts and reconciles filesystem state for every
+// volume known to every registered backend. Safe to call repeatedly; see
+// StartReconciler for running it on a schedule.
+func (d *VolumeDriver) Recover(ctx context.Context) error {
+	log.WithField("tracked", d.GetAttachedVolumes()).Info(
+		"Recovering volume state from Docker Engine")
+
+	for _, bname := range d.allBackendNames() {
+		volumes, err := d.backendFor(bname).List()
+		if err != nil {
+			log.WithField("backend", bname).WithError(err).Warning(
+				"failed to list volumes for backend during recovery")
+			continue
+		}
+
+		for _, vol := range volumes {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			d.rememberBackend(vol.Name, bname)
+			d.recoverVolume(vol.Name)
+		}
+	}
+	return nil
+}
+
+// recoverVolume reconciles a single volume's refcount/attach-mount state
+// against what the Docker Engine and the guest filesystem actually show.
+func (d *VolumeDriver) recoverVolume(name string) {
+	containerIDs, err := containersUsingVolumeFn(name)
+	if err != nil {
+		log.WithField("name", name).WithError(err).Warning(
+			"failed to query Docker Engine for volume users; leaving state untouched")
+		return
+	}
+
+	mountpoint := getMountPoint(name)
+	mounted := isMountedFn(mountpoint)
+
+	switch {
+	case len(containerIDs) > 0 && mounted:
+		// Matches our bookkeeping's expectations; just restore it to the
+		// observed count. Reconcile sets the refcount directly instead of
+		// replaying one Attach per container, so running this every
+		// reconciliation pass converges on the truth instead of adding the
+		// live container count on top of whatever was already there.
+		d.refCounts.Reconcile(name, uint(len(containerIDs)), true)
+		log.WithFields(log.Fields{
+			"name":       name,
+			"containers": len(containerIDs),
+		}).Info("Recovered mounted volume")
+
+	case len(containerIDs) > 0 && !mounted:
+		// A container expects this volume mounted, but it isn't - the
+		// plugin must have crashed mid-mount. Re-attach/mount it.
+		log.WithField("name", name).Warning(
+			"volume referenced by running containers but not mounted; remounting")
+
+		fstype := fs.FstypeDefault
+		isReadOnly := false
+		if status, err := d.opsFor(name).Get(name); err == nil {
+			if v, ok := status["fstype"].(string); ok {
+				fstype = v
+			}
+			if v, ok := status["access"].(string); ok && v == "read-only" {
+				isReadOnly = true
+			}
+		}
+
+		d.refCounts.Reconcile(name, uint(len(containerIDs)), false)
+		if _, err := d.mountVolume(
+			name, fstype, containerIDs[0], isReadOnly, false, false); err != nil {
+			log.WithField("name", name).WithError(err).Error(
+				"failed to remount volume during recovery")
+		}
+
+	case len(containerIDs) == 0 && mounted:
+		// Nobody references this volume any more; it's an orphan left
+		// behind by the crash. Zero out any stale refcount first so
+		// UnmountVolume's Detach doesn't get rejected as still in use.
+		log.WithField("name", name).Warning(
+			"volume mounted but unused; detaching orphan")
+		d.refCounts.Reconcile(name, 0, false)
+		if err := d.UnmountVolume(name); err != nil {
+			log.WithField("name", name).WithError(err).Warning(
+				"failed to detach orphaned volume during recovery")
+		}
+
+	default:
+		// Not mounted, not referenced: reconcile away any stale state left
+		// over from a previous buggy pass.
+		d.refCounts.Reconcile(name, 0, false)
+	}
+}
+
+// StartReconciler runs Recover every interval until ctx is cancelled, so a
+// long-running plugin self-heals from divergence between Docker's view of
+// volume usage and its own without requiring a restart.
+func (d *VolumeDriver) StartReconciler(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := d.Recover(ctx); err != nil {
+					log.WithError(err).Warning("periodic volume reconciliation failed")
+				}
+			}
+		}
+	}()
+}
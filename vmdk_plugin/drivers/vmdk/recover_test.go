@@ -0,0 +1,97 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+// withRecoveryStubs swaps containersUsingVolumeFn and isMountedFn for the
+// duration of a test, so recoverVolume can be exercised without a real
+// Docker Engine or real mounts. Returns a restore func the caller defers.
+func withRecoveryStubs(containerIDs []string, mounted bool) func() {
+	origContainers, origMounted := containersUsingVolumeFn, isMountedFn
+	containersUsingVolumeFn = func(string) ([]string, error) { return containerIDs, nil }
+	isMountedFn = func(string) bool { return mounted }
+	return func() {
+		containersUsingVolumeFn = origContainers
+		isMountedFn = origMounted
+	}
+}
+
+// TestRecoverVolumeAlreadyMountedIsNoop covers the ballooning bug fixed
+// alongside this test: a volume that is already correctly tracked as
+// attached/mounted must come out of repeated recoverVolume passes with the
+// same refcount it went in with, not one bumped per pass.
+func TestRecoverVolumeAlreadyMountedIsNoop(t *testing.T) {
+	defer withRecoveryStubs([]string{"container1"}, true)()
+
+	d := &VolumeDriver{refCounts: refcount.NewRefCountsMap()}
+	name := "vol1"
+
+	// Simulate the volume already being tracked as attached/mounted by a
+	// real Mount, the way it would be before any reconciliation pass runs.
+	d.refCounts.Reconcile(name, 1, true)
+
+	for i := 0; i < 3; i++ {
+		d.recoverVolume(name)
+		if got := d.refCounts.GetCount(name); got != 1 {
+			t.Fatalf("pass %d: refcount = %d, want 1 (no-op)", i, got)
+		}
+		if got := d.refCounts.GetState(name); got != refcount.Mounted {
+			t.Fatalf("pass %d: state = %s, want %s", i, got, refcount.Mounted)
+		}
+	}
+}
+
+// TestRecoverVolumeReconcilesMultipleContainers covers the same no-op
+// requirement when more than one container references the volume: the
+// refcount must converge to, not add to, the observed count.
+func TestRecoverVolumeReconcilesMultipleContainers(t *testing.T) {
+	defer withRecoveryStubs([]string{"container1", "container2"}, true)()
+
+	d := &VolumeDriver{refCounts: refcount.NewRefCountsMap()}
+	name := "vol1"
+	d.refCounts.Reconcile(name, 2, true)
+
+	d.recoverVolume(name)
+	d.recoverVolume(name)
+
+	if got := d.refCounts.GetCount(name); got != 2 {
+		t.Fatalf("refcount = %d, want 2 after repeated recovery passes", got)
+	}
+}
+
+// TestRecoverVolumeUnreferencedIsReconciledToZero covers the "not mounted,
+// not referenced" branch: a volume with stale non-zero bookkeeping (left
+// over from a previous buggy pass) must be brought back to Detached.
+func TestRecoverVolumeUnreferencedIsReconciledToZero(t *testing.T) {
+	defer withRecoveryStubs(nil, false)()
+
+	d := &VolumeDriver{refCounts: refcount.NewRefCountsMap()}
+	name := "vol1"
+	d.refCounts.Reconcile(name, 3, false)
+
+	d.recoverVolume(name)
+
+	if got := d.refCounts.GetCount(name); got != 0 {
+		t.Fatalf("refcount = %d, want 0", got)
+	}
+	if got := d.refCounts.GetState(name); got != refcount.Detached {
+		t.Fatalf("state = %s, want %s", got, refcount.Detached)
+	}
+}
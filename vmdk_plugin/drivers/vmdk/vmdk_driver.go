@@ -27,15 +27,18 @@ package vmdk
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/vmci"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/backend"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/plugin"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
 )
@@ -45,47 +48,87 @@ const (
 	sleepBeforeMount = 1 * time.Second
 	watchPath        = "/dev/disk/by-path"
 	version          = "vSphere Volume Driver v0.4"
+
+	// backendOption is the Create() option a volume uses to pick a
+	// non-default storage backend (see package backend).
+	backendOption = "backend"
+
+	// reconcileInterval is how often NewVolumeDriver's background
+	// reconciler re-runs Recover to self-heal from drift between the
+	// Docker Engine's view of volume usage and ours (see recover.go).
+	reconcileInterval = 5 * time.Minute
 )
 
 // VolumeDriver - VMDK driver struct
 type VolumeDriver struct {
 	useMockEsx bool
-	ops        vmdkops.VmdkOps
 	refCounts  *refcount.RefCountsMap
+
+	mtx         sync.Mutex
+	backends    map[string]backend.Ops // backend name -> live instance
+	volBackends map[string]string      // volume name -> backend name
 }
 
 var mountRoot string
 
+// vmdkOpsAdapter adapts the original vmdkops.VmdkOps type to backend.Ops so
+// it can sit in the registry next to any other registered backend; only
+// List needs translating since the rest of VmdkOps's method set already
+// matches.
+type vmdkOpsAdapter struct {
+	vmdkops.VmdkOps
+}
+
+func (a vmdkOpsAdapter) List() ([]backend.VolumeInfo, error) {
+	volumes, err := a.VmdkOps.List()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]backend.VolumeInfo, 0, len(volumes))
+	for _, v := range volumes {
+		infos = append(infos, backend.VolumeInfo{Name: v.Name})
+	}
+	return infos, nil
+}
+
 // NewVolumeDriver instantiates and returns a new VolumeDriver object.
 //
 // The flag useMockESX indicates whether or not to use a mock driver.
 func NewVolumeDriver(
 	port int, useMockEsx bool, mountDir, driverName string) *VolumeDriver {
 
-	var d *VolumeDriver
-
 	vmci.EsxPort = port
 	mountRoot = mountDir
 
+	var vmdkOps vmdkOpsAdapter
 	if useMockEsx {
-		d = &VolumeDriver{
-			useMockEsx: true,
-			ops:        vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{}},
-			refCounts:  refcount.NewRefCountsMap(),
-		}
+		vmdkOps = vmdkOpsAdapter{vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{}}}
 	} else {
-		d = &VolumeDriver{
-			useMockEsx: false,
-			ops: vmdkops.VmdkOps{
-				Cmd: vmci.EsxVmdkCmd{
-					Mtx: &sync.Mutex{},
-				},
+		vmdkOps = vmdkOpsAdapter{vmdkops.VmdkOps{
+			Cmd: vmci.EsxVmdkCmd{
+				Mtx: &sync.Mutex{},
 			},
-			refCounts: refcount.NewRefCountsMap(),
-		}
+		}}
+	}
+	backend.Register(backend.DefaultName, func() backend.Ops { return vmdkOps })
+
+	d := &VolumeDriver{
+		useMockEsx:  useMockEsx,
+		refCounts:   refcount.NewRefCountsMap(),
+		backends:    make(map[string]backend.Ops),
+		volBackends: make(map[string]string),
 	}
 
 	d.refCounts.Init(d, mountDir, driverName)
+
+	// A crashed plugin restarts with an empty refCounts, diverged from
+	// what is actually attached/mounted; reconcile once up front and then
+	// periodically, so long-running plugins self-heal without a restart.
+	if err := d.Recover(context.Background()); err != nil {
+		log.WithError(err).Warning("initial volume recovery failed")
+	}
+	d.StartReconciler(context.Background(), reconcileInterval)
+
 	log.WithFields(log.Fields{
 		"version":  version,
 		"port":     vmci.EsxPort,
@@ -95,36 +138,88 @@ func NewVolumeDriver(
 	return d
 }
 
-// getRefCount returns the number of references for the given volume.
-func (d *VolumeDriver) getRefCount(vol string) uint {
-	return d.refCounts.GetCount(vol)
+// backendFor returns the live backend.Ops instance for bname, constructing
+// and caching it on first use.
+func (d *VolumeDriver) backendFor(bname string) backend.Ops {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if ops, ok := d.backends[bname]; ok {
+		return ops
+	}
+
+	ops, err := backend.New(bname)
+	if err != nil {
+		log.WithField("backend", bname).WithError(err).Error(
+			"unknown volume backend; falling back to default")
+		bname = backend.DefaultName
+		ops = d.backends[bname]
+		if ops == nil {
+			ops, _ = backend.New(bname)
+		}
+	}
+	d.backends[bname] = ops
+	return ops
 }
 
-// incrRefCount increments the reference count for the given volume.
-func (d *VolumeDriver) incrRefCount(vol string) (refcnt uint) {
-	defer func() {
-		log.WithFields(log.Fields{
-			"name":   vol,
-			"refcnt": refcnt,
-		}).Debug("incremented ref count")
-	}()
-	return d.refCounts.Incr(vol)
+// rememberBackend records that vol is served by backend bname, so later
+// Mount/Unmount/Remove calls for it don't need to rediscover it.
+func (d *VolumeDriver) rememberBackend(vol, bname string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.volBackends[vol] = bname
 }
 
-// decrRefCount decrements the reference count for the given volume.
-func (d *VolumeDriver) decrRefCount(vol string) (refcnt uint, err error) {
-	defer func() {
-		if err != nil {
-			log.WithField("name", vol).WithError(err).Error(
-				"error decrementing ref count")
-			return
+// forgetBackend drops the cached backend mapping for vol, once it has been
+// removed.
+func (d *VolumeDriver) forgetBackend(vol string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.volBackends, vol)
+}
+
+// allBackendNames returns every registered backend name, default first.
+func (d *VolumeDriver) allBackendNames() []string {
+	names := []string{backend.DefaultName}
+	for _, n := range backend.Names() {
+		if n != backend.DefaultName {
+			names = append(names, n)
 		}
-		log.WithFields(log.Fields{
-			"name":   vol,
-			"refcnt": refcnt,
-		}).Debug("decremented ref count")
-	}()
-	return d.refCounts.Decr(vol)
+	}
+	return names
+}
+
+// opsFor returns the backend.Ops instance serving vol, discovering it by
+// asking each registered backend in turn if it knows about vol when the
+// mapping hasn't been recorded yet (e.g. after a plugin restart).
+func (d *VolumeDriver) opsFor(vol string) backend.Ops {
+	d.mtx.Lock()
+	bname, ok := d.volBackends[vol]
+	d.mtx.Unlock()
+	if ok {
+		return d.backendFor(bname)
+	}
+
+	for _, bname := range d.allBackendNames() {
+		ops := d.backendFor(bname)
+		if _, err := ops.Get(vol); err == nil {
+			d.rememberBackend(vol, bname)
+			return ops
+		}
+	}
+	return d.backendFor(backend.DefaultName)
+}
+
+// getRefCount returns the number of references for the given volume.
+func (d *VolumeDriver) getRefCount(vol string) uint {
+	return d.refCounts.GetCount(vol)
+}
+
+// GetAttachedVolumes returns the names of volumes currently attached or
+// mounted on this host, for diagnostics and for the recovery-on-restart
+// path.
+func (d *VolumeDriver) GetAttachedVolumes() []string {
+	return d.refCounts.GetAttachedVolumes()
 }
 
 // getMountPoint returns the mount point for the given volume.
@@ -133,43 +228,144 @@ func getMountPoint(volName string) string {
 }
 
 // Get returns info about a single volume.
-func (d *VolumeDriver) Get(r volume.Request) volume.Response {
+func (d *VolumeDriver) Get(r plugin.Request) plugin.Response {
 	status, err := d.GetVolume(r.Name)
 	if err != nil {
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
 	mountpoint := getMountPoint(r.Name)
-	return volume.Response{Volume: &volume.Volume{Name: r.Name,
+	return plugin.Response{Volume: &plugin.Volume{Name: r.Name,
 		Mountpoint: mountpoint,
 		Status:     status}}
 }
 
-// List returns the volumes known to the driver.
-func (d *VolumeDriver) List(r volume.Request) volume.Response {
-	volumes, err := d.ops.List()
-	if err != nil {
-		return volume.Response{Err: err.Error()}
-	}
-	responseVolumes := make([]*volume.Volume, 0, len(volumes))
-	for _, vol := range volumes {
-		mountpoint := getMountPoint(vol.Name)
-		responseVol := volume.Volume{Name: vol.Name, Mountpoint: mountpoint}
-		responseVolumes = append(responseVolumes, &responseVol)
+// List returns the volumes known to the driver across every registered
+// backend, narrowed by any docker-style filters present in r.Filters (see
+// matchesFilters).
+func (d *VolumeDriver) List(r plugin.Request) plugin.Response {
+	responseVolumes := make([]*plugin.Volume, 0)
+	for _, bname := range d.allBackendNames() {
+		volumes, err := d.backendFor(bname).List()
+		if err != nil {
+			log.WithField("backend", bname).WithError(err).Warning(
+				"failed to list volumes for backend")
+			continue
+		}
+		for _, vol := range volumes {
+			d.rememberBackend(vol.Name, bname)
+			if !d.matchesFilters(vol.Name, r.Filters) {
+				continue
+			}
+			mountpoint := getMountPoint(vol.Name)
+			responseVol := plugin.Volume{Name: vol.Name, Mountpoint: mountpoint}
+			responseVolumes = append(responseVolumes, &responseVol)
+		}
 	}
-	return volume.Response{Volumes: responseVolumes}
+	return plugin.Response{Volumes: responseVolumes}
 }
 
 // GetVolume returns a volume's meta-data.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
-	return d.ops.Get(name)
+	return d.opsFor(name).Get(name)
+}
+
+// matchesFilters reports whether vol satisfies every docker-style filter in
+// filters; an empty or nil filter set always matches. Supported filters:
+//
+//	dangling / unused - refcount == 0
+//	name              - filepath.Match glob against the volume name
+//	label             - "key" or "key=value" against volume metadata
+func (d *VolumeDriver) matchesFilters(name string, filters map[string][]string) bool {
+	for key, values := range filters {
+		switch key {
+		case "dangling", "unused":
+			if wantRefcountZero(values) != (d.getRefCount(name) == 0) {
+				return false
+			}
+		case "name":
+			if !matchesAnyGlob(name, values) {
+				return false
+			}
+		case "label":
+			if !d.matchesAnyLabel(name, values) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// wantRefcountZero returns false only if the filter explicitly asked for
+// "dangling=false"/"unused=false"; any other value (including none) means
+// "only volumes with refcount 0".
+func wantRefcountZero(values []string) bool {
+	for _, v := range values {
+		if v == "false" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAnyGlob reports whether name equals, or filepath-matches, any of
+// patterns.
+func matchesAnyGlob(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if name == pattern {
+			return true
+		}
+		if ok, err := filepath.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyLabel reports whether vol's metadata carries any of the given
+// "key" or "key=value" labels.
+func (d *VolumeDriver) matchesAnyLabel(name string, labels []string) bool {
+	status, err := d.opsFor(name).Get(name)
+	if err != nil {
+		return false
+	}
+	volLabels, ok := status["labels"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, label := range labels {
+		key, value := label, ""
+		if idx := strings.Index(label, "="); idx >= 0 {
+			key, value = label[:idx], label[idx+1:]
+		}
+		if v, ok := volLabels[key]; ok {
+			if value == "" || fmt.Sprintf("%v", v) == value {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // MountVolume - Request attach and them mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
 // Returns mount point and  error (or nil)
+//
+// Mount() moves the refCounts state machine out of Detached with
+// refCounts.Attach; the Attached/Mount/Mounted transitions are driven from
+// here, so that a Remove/Detach racing this call sees Attaching/Mounting and
+// fails cleanly instead of running concurrently with an in-progress mount.
 func (d *VolumeDriver) MountVolume(
 	name, fstype, id string,
 	isReadOnly, skipAttach bool) (string, error) {
+	return d.mountVolume(name, fstype, id, isReadOnly, skipAttach, false)
+}
+
+// mountVolume is MountVolume plus copyImageData, which - when true and the
+// volume turns out to be empty - seeds it with the image path content for
+// the container identified by id (see image_seed.go).
+func (d *VolumeDriver) mountVolume(
+	name, fstype, id string,
+	isReadOnly, skipAttach, copyImageData bool) (string, error) {
 
 	mountpoint := getMountPoint(name)
 
@@ -185,30 +381,51 @@ func (d *VolumeDriver) MountVolume(
 	watcher, skipInotify := fs.DevAttachWaitPrep(name, watchPath)
 
 	// Have ESX attach the disk
-	dev, err := d.ops.Attach(name, nil)
+	dev, err := d.opsFor(name).Attach(name, nil)
+	d.refCounts.Attached(name, err)
 	if err != nil {
 		return mountpoint, err
 	}
 
+	if err := d.refCounts.Mount(name); err != nil {
+		// Leave the device attached; the caller's failure cleanup will
+		// detach it since the refcount is still non-zero.
+		return mountpoint, err
+	}
+
+	// finishMount records the outcome of the filesystem mount and, on
+	// success, seeds a freshly emptied volume from the image path.
+	finishMount := func(mountErr error) (string, error) {
+		d.refCounts.Mounted(name, mountErr)
+		if mountErr == nil && copyImageData {
+			if err := seedFromImage(id, name, mountpoint); err != nil {
+				log.WithField("name", name).WithError(err).Warning(
+					"failed to seed volume with image content")
+			}
+		}
+		return mountpoint, mountErr
+	}
+
 	if d.useMockEsx {
-		return mountpoint, fs.Mount(mountpoint, fstype, string(dev[:]), false)
+		return finishMount(fs.Mount(mountpoint, fstype, string(dev[:]), false))
 	}
 
 	device, err := fs.GetDevicePath(dev)
 	if err != nil {
+		d.refCounts.Mounted(name, err)
 		return mountpoint, err
 	}
 
 	if skipInotify {
 		time.Sleep(sleepBeforeMount)
-		return mountpoint, fs.Mount(mountpoint, fstype, device, false)
+		return finishMount(fs.Mount(mountpoint, fstype, device, false))
 	}
 
 	fs.DevAttachWait(watcher, name, device)
 
 	// May have timed out waiting for the attach to complete,
 	// attempt the mount anyway.
-	return mountpoint, fs.Mount(mountpoint, fstype, device, isReadOnly)
+	return finishMount(fs.Mount(mountpoint, fstype, device, isReadOnly))
 }
 
 // UnmountVolume unmounts the volume then submits a detach request.
@@ -219,7 +436,16 @@ func (d *VolumeDriver) UnmountVolume(name string) error {
 			"Failed to unmount volume. Now trying to detach...")
 		// Do not return error. Continue with detach.
 	}
-	return d.ops.Detach(name, nil)
+	d.refCounts.Unmounted(name, nil)
+
+	if err := d.refCounts.Detach(name); err != nil {
+		log.WithField("name", name).WithError(err).Error(
+			"Refused to detach volume")
+		return err
+	}
+	err := d.opsFor(name).Detach(name, nil)
+	d.refCounts.Detached(name, err)
+	return err
 }
 
 // No need to actually manifest the volume on the filesystem yet
@@ -227,20 +453,36 @@ func (d *VolumeDriver) UnmountVolume(name string) error {
 // Name and driver specific options passed through to the ESX host
 
 // Create submits a volume creation request.
-func (d *VolumeDriver) Create(r volume.Request) volume.Response {
+func (d *VolumeDriver) Create(r plugin.Request) plugin.Response {
 
 	if r.Options == nil {
 		r.Options = make(map[string]string)
 	}
 
+	// Pick the storage backend for this volume; ops persists the option
+	// as volume metadata along with the rest. After a plugin restart,
+	// later Mount/Remove calls find the backend again by asking each
+	// registered backend for the volume (see opsFor).
+	bname := r.Options[backendOption]
+	if bname == "" {
+		bname = backend.DefaultName
+		r.Options[backendOption] = bname
+	} else if !backend.Exists(bname) {
+		err := fmt.Errorf("unknown volume backend %q", bname)
+		log.WithField("name", r.Name).WithError(err).Error("Create volume failed")
+		return plugin.Response{Err: err.Error()}
+	}
+	ops := d.backendFor(bname)
+
 	// If cloning a existent volume, create and return
 	if _, ok := r.Options["clone-from"]; ok {
-		if err := d.ops.Create(r.Name, r.Options); err != nil {
+		if err := ops.Create(r.Name, r.Options); err != nil {
 			log.WithField("name", r.Name).WithError(err).Error(
 				"Clone volume failed")
-			return volume.Response{Err: err.Error()}
+			return plugin.Response{Err: err.Error()}
 		}
-		return volume.Response{Err: ""}
+		d.rememberBackend(r.Name, bname)
+		return plugin.Response{Err: ""}
 	}
 
 	// Use default fstype if not specified
@@ -248,6 +490,13 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		r.Options["fstype"] = fs.FstypeDefault
 	}
 
+	// Default to not seeding the volume from the image path content; ops
+	// persists this option as volume metadata along with the rest, so
+	// Mount can look it up again on first mount.
+	if _, ok := r.Options[copyImageDataOption]; !ok {
+		r.Options[copyImageDataOption] = "false"
+	}
+
 	// Get existent filesystem tools
 	supportedFs := fs.MkfsLookup()
 
@@ -270,14 +519,15 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 			"name":   r.Name,
 			"fstype": r.Options["fstype"],
 		}).Error("Not found")
-		return volume.Response{Err: buf.String()}
+		return plugin.Response{Err: buf.String()}
 	}
 
-	if err := d.ops.Create(r.Name, r.Options); err != nil {
+	if err := ops.Create(r.Name, r.Options); err != nil {
 		log.WithField("name", r.Name).WithError(err).Error(
 			"Create volume failed")
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
+	d.rememberBackend(r.Name, bname)
 
 	// Handle filesystem creation
 	log.WithFields(log.Fields{
@@ -287,33 +537,33 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 
 	watcher, skipInotify := fs.DevAttachWaitPrep(r.Name, watchPath)
 
-	dev, errAttach := d.ops.Attach(r.Name, nil)
+	dev, errAttach := ops.Attach(r.Name, nil)
 	if errAttach != nil {
 		log.WithField("name", r.Name).WithError(errAttach).Error(
 			"Attach volume failed; removing the volume")
 		// An internal error for the attach may have the volume attached to
 		// this client, detach before removing below.
-		d.ops.Detach(r.Name, nil)
-		if err := d.ops.Remove(r.Name, nil); err != nil {
+		ops.Detach(r.Name, nil)
+		if err := ops.Remove(r.Name, nil); err != nil {
 			log.WithField("name", r.Name).WithError(err).Warning(
 				"Remove volume failed")
 		}
-		return volume.Response{Err: errAttach.Error()}
+		return plugin.Response{Err: errAttach.Error()}
 	}
 
 	device, errGetDevicePath := fs.GetDevicePath(dev)
 	if errGetDevicePath != nil {
 		log.WithField("name", r.Name).WithError(errGetDevicePath).Error(
 			"Could not find attached device; removing the volume")
-		if err := d.ops.Detach(r.Name, nil); err != nil {
+		if err := ops.Detach(r.Name, nil); err != nil {
 			log.WithField("name", r.Name).WithError(err).Warn(
 				"Detach volume failed")
 		}
-		if err := d.ops.Remove(r.Name, nil); err != nil {
+		if err := ops.Remove(r.Name, nil); err != nil {
 			log.WithField("name", r.Name).WithError(err).Warn(
 				"Remove volume failed")
 		}
-		return volume.Response{Err: errGetDevicePath.Error()}
+		return plugin.Response{Err: errGetDevicePath.Error()}
 	}
 
 	if skipInotify {
@@ -326,59 +576,128 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	if err := fs.Mkfs(mkfscmd, r.Name, device); err != nil {
 		log.WithField("name", r.Name).WithError(err).Error(
 			"Create filesystem failed, removing the volume")
-		if err := d.ops.Detach(r.Name, nil); err != nil {
+		if err := ops.Detach(r.Name, nil); err != nil {
 			log.WithField("name", r.Name).WithError(err).Warn(
 				"Detach volume failed")
 		}
-		if err := d.ops.Remove(r.Name, nil); err != nil {
+		if err := ops.Remove(r.Name, nil); err != nil {
 			log.WithField("name", r.Name).WithError(err).Warn(
 				"Remove volume failed")
 		}
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
 
-	if err := d.ops.Detach(r.Name, nil); err != nil {
+	if err := ops.Detach(r.Name, nil); err != nil {
 		log.WithField("name", r.Name).WithError(err).Error(
 			"Detach volume failed")
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
 
 	log.WithFields(log.Fields{
 		"name":   r.Name,
 		"fstype": r.Options["fstype"],
 	}).Info("Volume and filesystem created")
-	return volume.Response{Err: ""}
+	return plugin.Response{Err: ""}
 }
 
 // Remove - removes individual volume. Docker would call it only if is not
 // using it anymore
-func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
+func (d *VolumeDriver) Remove(r plugin.Request) plugin.Response {
 	log.WithField("name", r.Name).Info("Removing volume")
 
 	// Docker is supposed to block 'remove' command if the volume is used.
-	// Verify.
-	if refcnt := d.getRefCount(r.Name); refcnt != 0 {
-		log.WithFields(log.Fields{
-			"name":   r.Name,
-			"refcnt": refcnt,
-		}).Error("remove failure; volume is still mounted")
-		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
-			" volume=%s, refcount=%d", r.Name, refcnt)
-		return volume.Response{Err: msg}
+	// Verify, and also reject a Remove racing an in-progress Attach/Mount
+	// of the same volume rather than running concurrently with it.
+	if err := d.refCounts.CanRemove(r.Name); err != nil {
+		log.WithField("name", r.Name).WithError(err).Error(
+			"remove failure; volume is busy")
+		return plugin.Response{Err: err.Error()}
 	}
 
-	if err := d.ops.Remove(r.Name, r.Options); err != nil {
+	if err := d.opsFor(r.Name).Remove(r.Name, r.Options); err != nil {
 		log.WithField("name", r.Name).WithError(err).Error(
 			"Failed to remove volume")
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
+	}
+	d.forgetBackend(r.Name)
+
+	return plugin.Response{Err: ""}
+}
+
+// Prune removes every volume not currently in use (refcount == 0) across
+// every registered backend, optionally narrowed by the same filters List
+// accepts (see matchesFilters), and reports what it deleted. Mirrors the
+// semantics of the Docker daemon's VolumesPrune for bulk cleanup by
+// orchestrators.
+func (d *VolumeDriver) Prune(r plugin.Request) plugin.Response {
+	log.WithField("filters", r.Filters).Info("Pruning volumes")
+
+	report := &plugin.PruneReport{VolumesDeleted: []string{}}
+	for _, bname := range d.allBackendNames() {
+		ops := d.backendFor(bname)
+		volumes, err := ops.List()
+		if err != nil {
+			log.WithField("backend", bname).WithError(err).Warning(
+				"failed to list volumes for backend during prune")
+			continue
+		}
+
+		for _, vol := range volumes {
+			d.rememberBackend(vol.Name, bname)
+			if d.getRefCount(vol.Name) != 0 {
+				continue
+			}
+			if !d.matchesFilters(vol.Name, r.Filters) {
+				continue
+			}
+			if err := d.refCounts.CanRemove(vol.Name); err != nil {
+				log.WithField("name", vol.Name).WithError(err).Warning(
+					"skipping volume during prune; volume is busy")
+				continue
+			}
+
+			reclaimed := d.volumeSize(vol.Name)
+			if err := ops.Remove(vol.Name, nil); err != nil {
+				log.WithField("name", vol.Name).WithError(err).Warning(
+					"failed to remove volume during prune")
+				continue
+			}
+			d.forgetBackend(vol.Name)
+			report.VolumesDeleted = append(report.VolumesDeleted, vol.Name)
+			report.SpaceReclaimed += reclaimed
+		}
 	}
 
-	return volume.Response{Err: ""}
+	log.WithFields(log.Fields{
+		"deleted": len(report.VolumesDeleted),
+		"space":   report.SpaceReclaimed,
+	}).Info("Pruned volumes")
+	return plugin.Response{PruneReport: report}
+}
+
+// volumeSize returns the best-effort size, in bytes, reported in a volume's
+// metadata. Used to populate PruneReport.SpaceReclaimed; volumes that don't
+// report a size contribute 0.
+func (d *VolumeDriver) volumeSize(name string) uint64 {
+	status, err := d.opsFor(name).Get(name)
+	if err != nil {
+		return 0
+	}
+	switch size := status["size"].(type) {
+	case uint64:
+		return size
+	case int64:
+		return uint64(size)
+	case float64:
+		return uint64(size)
+	default:
+		return 0
+	}
 }
 
 // Path - give docker a reminder of the volume mount path
-func (d *VolumeDriver) Path(r volume.Request) volume.Response {
-	return volume.Response{Mountpoint: getMountPoint(r.Name)}
+func (d *VolumeDriver) Path(r plugin.Request) plugin.Response {
+	return plugin.Response{Mountpoint: getMountPoint(r.Name)}
 }
 
 // Mount - Provide a volume to docker container - called once per container
@@ -390,31 +709,37 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 // As long as the refCountsMap is protected is unnecessary to do any locking
 // at this level during create/mount/umount/remove.
 //
-func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
+func (d *VolumeDriver) Mount(r plugin.MountRequest) plugin.Response {
 	log.WithField("name", r.Name).Info("Mounting volume")
 
-	// If the volume is already mounted , just increase the refcount.
-	//
-	// Note: We are deliberately incrementing refcount first, before trying
-	// to do anything else. If Mount fails, Docker will send Unmount request,
-	// and we will happily decrement the refcount there, and will fail the
-	// unmount since the volume will have been never mounted.
+	// If the volume is already mounted, just increase the refcount.
 	//
-	// Note: for new keys, GO maps return zero value, so no need for if_exists.
-
-	if refcnt := d.incrRefCount(r.Name); refcnt > 1 { // save map traversal
+	// Note: We are deliberately bumping the refcount first, before trying
+	// to do anything else, and moving the volume's state machine out of
+	// Detached right away. If Mount fails, Docker will send Unmount
+	// request, and we will happily decrement the refcount there; a
+	// Remove/Detach racing this call in the meantime sees the volume as
+	// Attaching/Mounting and is rejected instead of running concurrently
+	// with us.
+	refcnt, err := d.refCounts.Attach(r.Name)
+	if err != nil {
+		log.WithField("name", r.Name).WithError(err).Error(
+			"failed to mount; volume busy")
+		return plugin.Response{Err: err.Error()}
+	}
+	if refcnt > 1 { // save map traversal
 		log.WithFields(log.Fields{
 			"name":   r.Name,
 			"refcnt": refcnt,
 		}).Debug("already mounted; skipping mount")
-		return volume.Response{Mountpoint: getMountPoint(r.Name)}
+		return plugin.Response{Mountpoint: getMountPoint(r.Name)}
 	}
 
 	// This is the first time we are asked to mount the volume, so comply
-	status, err := d.ops.Get(r.Name)
+	status, err := d.opsFor(r.Name).Get(r.Name)
 	if err != nil {
-		d.decrRefCount(r.Name)
-		return volume.Response{Err: err.Error()}
+		d.refCounts.Attached(r.Name, err)
+		return plugin.Response{Err: err.Error()}
 	}
 
 	var (
@@ -446,54 +771,70 @@ func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 
 	fstype = value
 
-	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false)
+	mountpoint, err := d.mountVolume(
+		r.Name, fstype, r.ID, isReadOnly, false, wantsImageSeed(status))
 	if err != nil {
 		log.WithField("name", r.Name).WithError(err).Error("failed to mount")
 
-		if refcnt, _ := d.decrRefCount(r.Name); refcnt == 0 {
+		if refcnt, doUnmount, unmountErr := d.refCounts.Unmount(r.Name); doUnmount {
+			if unmountErr != nil {
+				log.WithField("name", r.Name).WithError(unmountErr).Warning(
+					"Refcount error - still trying to detach...")
+			}
 			log.WithField("name", r.Name).Info("detaching unused volume")
 
-			// try to detach before failing the request for volume
-			d.ops.Detach(r.Name, nil)
+			// There is no filesystem mount to undo here (mountVolume failed
+			// before or during fs.Mount), so go straight from Unmounting to
+			// Detaching, the same way UnmountVolume does once fs.Unmount is
+			// done.
+			d.refCounts.Unmounted(r.Name, nil)
+			if detachErr := d.refCounts.Detach(r.Name); detachErr == nil {
+				d.refCounts.Detached(r.Name, d.opsFor(r.Name).Detach(r.Name, nil))
+			}
+		} else {
+			log.WithFields(log.Fields{
+				"name":   r.Name,
+				"refcnt": refcnt,
+			}).Debug("volume still referenced; leaving attached")
 		}
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
 
-	return volume.Response{Mountpoint: mountpoint}
+	return plugin.Response{Mountpoint: mountpoint}
 }
 
 // Unmount request from Docker. If mount refcount is drop to 0.
 // Unmount and detach from VM
-func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
+func (d *VolumeDriver) Unmount(r plugin.UnmountRequest) plugin.Response {
 	log.WithField("name", r.Name).Info("Unmounting Volume")
 
 	// if the volume is still used by other containers, just return OK
-	refcnt, err := d.decrRefCount(r.Name)
+	refcnt, doUnmount, err := d.refCounts.Unmount(r.Name)
 	if err != nil {
 		// something went wrong - yell, but still try to unmount
 		log.WithFields(log.Fields{
 			"name":     r.Name,
 			"refcount": refcnt,
-		}).Error("Refcount error - still trying to unmount...")
+		}).WithError(err).Error("Refcount error - still trying to unmount...")
 	}
 
-	if refcnt >= 1 {
+	if !doUnmount {
 		log.WithFields(log.Fields{
 			"name":     r.Name,
 			"refcount": refcnt,
 		}).Debug("volume still in used; skipping unmount request")
-		return volume.Response{Err: ""}
+		return plugin.Response{Err: ""}
 	}
 
 	// and if nobody needs it, unmount and detach
 	if err := d.UnmountVolume(r.Name); err != nil {
 		log.WithField("name", r.Name).WithError(err).Error("failed to mount")
-		return volume.Response{Err: err.Error()}
+		return plugin.Response{Err: err.Error()}
 	}
-	return volume.Response{Err: ""}
+	return plugin.Response{Err: ""}
 }
 
 // Capabilities - Report plugin scope to Docker
-func (d *VolumeDriver) Capabilities(r volume.Request) volume.Response {
-	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
+func (d *VolumeDriver) Capabilities(r plugin.Request) plugin.Response {
+	return plugin.Response{Capabilities: plugin.Capability{Scope: "global"}}
 }
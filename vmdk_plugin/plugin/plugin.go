@@ -0,0 +1,381 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugin implements the Docker Volume Plugin API v1.1 over HTTP,
+// served on a Unix socket and, optionally, a TCP listener with TLS.
+//
+// It replaces github.com/docker/go-plugins-helpers/volume so the driver can
+// control content-type negotiation, request timeouts, panic recovery,
+// structured request/response logging and per-endpoint metrics, and front
+// the socket with a token-auth middleware for remote debugging/management -
+// none of which the helpers library exposes.
+package plugin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	activateResponse = `{"Implements": ["VolumeDriver"]}`
+	contentType      = "application/vnd.docker.plugins.v1.1+json"
+	defaultTimeout   = 10 * time.Second
+
+	// slowTimeout bounds the endpoints that can legitimately run well past
+	// defaultTimeout in a real vSphere environment - Mount/Unmount (device-
+	// attach wait loops), Create (mkfs on a large disk) and Prune (deleting
+	// many volumes). Giving them the same 10s ceiling as everything else
+	// would have Docker see a truncated response on a slow-but-successful
+	// call where none was warranted.
+	slowTimeout = 5 * time.Minute
+)
+
+// Request is the common request body sent by Docker for most endpoints.
+// Filters carries the docker-style filter arguments used by List and Prune
+// (e.g. {"dangling": ["true"]}); it is empty for endpoints that don't take
+// filters.
+type Request struct {
+	Name    string
+	Options map[string]string   `json:"Opts,omitempty"`
+	Filters map[string][]string `json:"Filters,omitempty"`
+}
+
+// MountRequest is sent to /VolumeDriver.Mount.
+type MountRequest struct {
+	Name string
+	ID   string
+}
+
+// UnmountRequest is sent to /VolumeDriver.Unmount.
+type UnmountRequest struct {
+	Name string
+	ID   string
+}
+
+// Volume describes a single volume in a List/Get response.
+type Volume struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	CreatedAt  string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+// Capability describes the plugin's scope, returned from Capabilities.
+type Capability struct {
+	Scope string
+}
+
+// PruneReport is returned from Prune, summarizing what got cleaned up.
+type PruneReport struct {
+	VolumesDeleted []string
+	SpaceReclaimed uint64
+}
+
+// Response is the common response body returned from every endpoint. Only
+// the fields relevant to the request being answered are populated.
+type Response struct {
+	Mountpoint   string       `json:",omitempty"`
+	Err          string       `json:",omitempty"`
+	Volume       *Volume      `json:",omitempty"`
+	Volumes      []*Volume    `json:",omitempty"`
+	Capabilities Capability   `json:",omitempty"`
+	PruneReport  *PruneReport `json:",omitempty"`
+}
+
+// Driver is implemented by a Docker volume driver that wants to be served
+// over the Docker Volume Plugin API.
+type Driver interface {
+	Create(Request) Response
+	List(Request) Response
+	Get(Request) Response
+	Remove(Request) Response
+	Path(Request) Response
+	Mount(MountRequest) Response
+	Unmount(UnmountRequest) Response
+	Capabilities(Request) Response
+	Prune(Request) Response
+}
+
+// Handler serves a Driver's methods over HTTP, per the Docker Volume
+// Plugin API v1.1.
+type Handler struct {
+	driver Driver
+	mux    *http.ServeMux
+
+	// AuthToken, when non-empty, is required as a "Bearer <token>"
+	// Authorization header on every request. Meant for the optional TCP
+	// listener used for remote debugging/management; the Unix socket is
+	// already access-controlled by filesystem permissions.
+	AuthToken string
+
+	mtx     sync.Mutex
+	metrics map[string]uint64
+}
+
+// NewHandler creates a Handler serving d's methods.
+func NewHandler(d Driver) *Handler {
+	h := &Handler{driver: d, metrics: make(map[string]uint64)}
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("/Plugin.Activate", h.wrap("Plugin.Activate", h.activate, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Create", h.wrap("VolumeDriver.Create", h.create, slowTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Get", h.wrap("VolumeDriver.Get", h.get, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.List", h.wrap("VolumeDriver.List", h.list, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Remove", h.wrap("VolumeDriver.Remove", h.remove, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Path", h.wrap("VolumeDriver.Path", h.path, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Mount", h.wrap("VolumeDriver.Mount", h.mount, slowTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Unmount", h.wrap("VolumeDriver.Unmount", h.unmount, slowTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Capabilities", h.wrap("VolumeDriver.Capabilities", h.capabilities, defaultTimeout))
+	h.mux.HandleFunc("/VolumeDriver.Prune", h.wrap("VolumeDriver.Prune", h.prune, slowTimeout))
+	return h
+}
+
+// Metrics returns a snapshot of the request counts seen so far, keyed by
+// endpoint name.
+func (h *Handler) Metrics() map[string]uint64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	snapshot := make(map[string]uint64, len(h.metrics))
+	for k, v := range h.metrics {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// wrap applies panic recovery, request/response logging, metrics,
+// auth-token enforcement (on every listener, whenever AuthToken is set),
+// and a per-endpoint timeout
+// around an endpoint handler. The timeout is enforced here rather than via
+// http.Server.WriteTimeout, which is a single blanket deadline for every
+// endpoint on the server; this lets Mount/Create/Prune run far longer than
+// the rest without loosening the deadline everywhere.
+func (h *Handler) wrap(name string, fn func(w http.ResponseWriter, r *http.Request), timeout time.Duration) http.HandlerFunc {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.WithFields(log.Fields{
+					"endpoint": name,
+					"panic":    rec,
+				}).Error("plugin handler panicked")
+				h.writeError(w, fmt.Errorf("internal error"))
+			}
+		}()
+
+		if !h.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.mtx.Lock()
+		h.metrics[name]++
+		h.mtx.Unlock()
+
+		log.WithField("endpoint", name).Debug("handling plugin request")
+		fn(w, r)
+		log.WithFields(log.Fields{
+			"endpoint": name,
+			"duration": time.Since(start),
+		}).Debug("handled plugin request")
+	})
+	return http.TimeoutHandler(handler, timeout, `{"Err":"plugin request timed out"}`).ServeHTTP
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.AuthToken == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	return auth == "Bearer "+h.AuthToken
+}
+
+func (h *Handler) writeResponse(w http.ResponseWriter, resp Response) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.WithError(err).Error("failed to encode plugin response")
+	}
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, err error) {
+	h.writeResponse(w, Response{Err: err.Error()})
+}
+
+func (h *Handler) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+	if r.Body == nil {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		h.writeError(w, err)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) activate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprint(w, activateResponse)
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Create(req))
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Get(req))
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.List(req))
+}
+
+func (h *Handler) remove(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Remove(req))
+}
+
+func (h *Handler) path(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Path(req))
+}
+
+func (h *Handler) mount(w http.ResponseWriter, r *http.Request) {
+	var req MountRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Mount(req))
+}
+
+func (h *Handler) unmount(w http.ResponseWriter, r *http.Request) {
+	var req UnmountRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Unmount(req))
+}
+
+func (h *Handler) capabilities(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Capabilities(req))
+}
+
+func (h *Handler) prune(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if !h.decode(w, r, &req) {
+		return
+	}
+	h.writeResponse(w, h.driver.Prune(req))
+}
+
+// pluginSockDir is where the Docker daemon expects to find plugin Unix
+// sockets.
+const pluginSockDir = "/run/docker/plugins"
+
+// ServeUnix serves the handler on a Unix socket named <name>.sock under
+// pluginSockDir, as required by the Docker plugin discovery protocol. A
+// name containing "/" is used as the socket path as it is.
+func (h *Handler) ServeUnix(name string, gid int) error {
+	sockPath := name
+	if !strings.Contains(sockPath, "/") {
+		if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+			return err
+		}
+		sockPath = pluginSockDir + "/" + name + ".sock"
+	}
+	os.Remove(sockPath)
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(sockPath, 0, gid); err != nil {
+		log.WithField("socket", sockPath).WithError(err).Warn(
+			"failed to chown plugin socket")
+	}
+	if err := os.Chmod(sockPath, 0660); err != nil {
+		log.WithField("socket", sockPath).WithError(err).Warn(
+			"failed to chmod plugin socket")
+	}
+
+	// WriteTimeout is deliberately left unset: it is a single deadline for
+	// every endpoint, which would undo the per-endpoint timeouts applied in
+	// wrap(). ReadTimeout still bounds how long we wait for a request body.
+	server := &http.Server{Handler: h.mux, ReadTimeout: defaultTimeout}
+	log.WithField("socket", sockPath).Info("Serving Docker volume plugin API")
+	return server.Serve(listener)
+}
+
+// ServeTCP serves the handler on addr, optionally with TLS when certFile
+// and keyFile are both non-empty. Intended for remote debugging/management;
+// AuthToken should be set when using this listener.
+func (h *Handler) ServeTCP(addr, certFile, keyFile string) error {
+	// See ServeUnix for why WriteTimeout is left unset.
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     h.mux,
+		ReadTimeout: defaultTimeout,
+	}
+
+	if certFile == "" && keyFile == "" {
+		log.WithField("addr", addr).Warn(
+			"Serving Docker volume plugin API over TCP without TLS")
+		return server.ListenAndServe()
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	log.WithField("addr", addr).Info("Serving Docker volume plugin API over TLS")
+	listener, err := tls.Listen("tcp", addr, server.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,408 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+//
+// Tracks, for every volume known to the plugin, how many containers are
+// using it and where the volume currently sits in the attach/mount
+// lifecycle.
+//
+// A plain refcount map is not enough to protect against a detach racing an
+// in-progress mount (Docker sending Unmount before a slow Mount has
+// returned, or a concurrent Remove). Every volume therefore gets its own
+// state machine and its own mutex, so Attach/Mount/Unmount/Detach/Remove
+// requests against the *same* volume are serialized and validated, while
+// requests against different volumes never block each other.
+//
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// State is a volume's position in the attach/mount lifecycle.
+type State int
+
+// Valid volume states. A volume starts and ends each lifecycle in
+// Detached; Attached and Mounted are held while the volume is in use, and
+// the other states exist only while a request is in flight.
+const (
+	Detached State = iota
+	Attaching
+	Attached
+	Mounting
+	Mounted
+	Unmounting
+	Detaching
+)
+
+func (s State) String() string {
+	switch s {
+	case Detached:
+		return "detached"
+	case Attaching:
+		return "attaching"
+	case Attached:
+		return "attached"
+	case Mounting:
+		return "mounting"
+	case Mounted:
+		return "mounted"
+	case Unmounting:
+		return "unmounting"
+	case Detaching:
+		return "detaching"
+	default:
+		return "unknown"
+	}
+}
+
+// BusyError is returned when a request arrives for a volume that is in the
+// middle of another state transition (e.g. Remove racing an in-flight
+// Mount).
+type BusyError struct {
+	Name  string
+	State State
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("volume %s is busy (state=%s)", e.Name, e.State)
+}
+
+// volState is the per-volume bookkeeping entry, guarded by its own mutex so
+// that operations on different volumes never contend with each other.
+type volState struct {
+	mtx      sync.Mutex
+	state    State
+	refCount uint
+}
+
+// RefCountsMap tracks refcount and attach/mount state for every volume
+// known to this plugin.
+type RefCountsMap struct {
+	mtx        sync.Mutex // protects creation/removal of entries in vols
+	vols       map[string]*volState
+	mountRoot  string
+	driverName string
+}
+
+// NewRefCountsMap creates an empty, ready to use RefCountsMap.
+func NewRefCountsMap() *RefCountsMap {
+	return &RefCountsMap{vols: make(map[string]*volState)}
+}
+
+// Init remembers where volumes get mounted and under which driver name.
+// Nothing in this package reads them back; VolumeDriver.Recover rebuilds
+// the map through Reconcile from what the Docker Engine reports.
+func (r *RefCountsMap) Init(d interface{}, mountDir, driverName string) {
+	r.mountRoot = mountDir
+	r.driverName = driverName
+}
+
+func (r *RefCountsMap) getOrCreate(name string) *volState {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	v, ok := r.vols[name]
+	if !ok {
+		v = &volState{state: Detached}
+		r.vols[name] = v
+	}
+	return v
+}
+
+// GetCount returns the number of containers currently referencing the
+// volume.
+func (r *RefCountsMap) GetCount(name string) uint {
+	r.mtx.Lock()
+	v, ok := r.vols[name]
+	r.mtx.Unlock()
+	if !ok {
+		return 0
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.refCount
+}
+
+// GetState returns the current lifecycle state of a volume.
+func (r *RefCountsMap) GetState(name string) State {
+	r.mtx.Lock()
+	v, ok := r.vols[name]
+	r.mtx.Unlock()
+	if !ok {
+		return Detached
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.state
+}
+
+// GetAttachedVolumes returns the names of volumes that are currently
+// attached or mounted. Used for diagnostics and by the plugin's
+// recovery-on-restart path.
+func (r *RefCountsMap) GetAttachedVolumes() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	names := make([]string, 0, len(r.vols))
+	for name, v := range r.vols {
+		v.mtx.Lock()
+		state := v.state
+		v.mtx.Unlock()
+		if state != Detached {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Reconcile sets name's refcount and attach/mount state directly to the
+// values the caller observed (e.g. the number of running containers
+// actually referencing the volume, and whether it is mounted), rather
+// than deriving them by replaying Attach/Mount calls.
+//
+// This exists for VolumeDriver.Recover, which re-derives ground truth from
+// the Docker Engine every time it runs: Attach/Mount are additive (meant
+// for one container's request at a time) and calling them once per
+// container on every reconciliation pass would double-count a volume's
+// refcount on every pass instead of resetting it to what was observed.
+func (r *RefCountsMap) Reconcile(name string, count uint, mounted bool) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	v.refCount = count
+	switch {
+	case count == 0:
+		v.state = Detached
+	case mounted:
+		v.state = Mounted
+	default:
+		v.state = Attached
+	}
+}
+
+// Attach begins attaching a volume. For the first caller (refcount 0->1)
+// the volume transitions Detached->Attaching, so a Remove or Detach racing
+// this call is rejected with a *BusyError instead of running concurrently
+// with the attach. Callers that find the volume already attached/mounted
+// just get the bumped refcount back and should skip the actual
+// ops.Attach() call.
+func (r *RefCountsMap) Attach(name string) (refcnt uint, err error) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	v.refCount++
+	if v.refCount > 1 {
+		return v.refCount, nil
+	}
+
+	if v.state != Detached {
+		v.refCount--
+		return v.refCount, &BusyError{Name: name, State: v.state}
+	}
+
+	v.state = Attaching
+	return v.refCount, nil
+}
+
+// Attached records the outcome of the ops.Attach() call started by Attach.
+// On failure the refcount is rolled back and the volume returns to
+// Detached.
+func (r *RefCountsMap) Attached(name string, attachErr error) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.state != Attaching {
+		// We were not the caller that initiated the attach (refcount was
+		// already > 1); nothing to do.
+		return
+	}
+
+	if attachErr != nil {
+		v.state = Detached
+		if v.refCount > 0 {
+			v.refCount--
+		}
+		return
+	}
+	v.state = Attached
+}
+
+// Mount transitions an Attached volume into Mounting, ahead of the actual
+// filesystem mount. It fails if the volume is not in a state where
+// mounting makes sense (e.g. a Detach is already in flight).
+func (r *RefCountsMap) Mount(name string) error {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	switch v.state {
+	case Attached:
+		v.state = Mounting
+		return nil
+	case Mounted, Mounting:
+		// Another container is already using the same mount; nothing to do.
+		return nil
+	default:
+		return &BusyError{Name: name, State: v.state}
+	}
+}
+
+// Mounted records the outcome of the filesystem mount started by Mount.
+func (r *RefCountsMap) Mounted(name string, mountErr error) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.state != Mounting {
+		return
+	}
+	if mountErr != nil {
+		v.state = Attached
+		return
+	}
+	v.state = Mounted
+}
+
+// Unmount decrements the refcount for a volume. When the last reference
+// goes away (refcount hits 0) it transitions to Unmounting and tells the
+// caller to actually unmount; otherwise the caller should just return since
+// the volume is still in use.
+//
+// The caller is told to unmount whenever the refcount hits zero, even if
+// the volume never reached (or fell back out of) Mounted - e.g. because a
+// prior Mount attempt failed partway through. Leaving the volume attached
+// in that case would wedge it: the next Mount would find it stuck outside
+// Detached and fail forever. When that happens this returns a non-nil err
+// alongside doUnmount=true, purely so the caller can log that the state
+// machine did not end up where expected; the caller must still proceed.
+func (r *RefCountsMap) Unmount(name string) (refcnt uint, doUnmount bool, err error) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.refCount == 0 {
+		log.WithField("name", name).Warning(
+			"Unmount request for a volume with refcount already at 0")
+		return 0, false, fmt.Errorf("refcount for %s is already 0", name)
+	}
+
+	v.refCount--
+	if v.refCount > 0 {
+		return v.refCount, false, nil
+	}
+
+	if v.state != Mounted {
+		err = &BusyError{Name: name, State: v.state}
+	}
+	v.state = Unmounting
+	return v.refCount, true, err
+}
+
+// Unmounted records the outcome of the filesystem unmount started by
+// Unmount.
+func (r *RefCountsMap) Unmounted(name string, unmountErr error) {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.state != Unmounting {
+		return
+	}
+	// We try to detach regardless of whether the unmount itself succeeded;
+	// staying Mounted would wedge the volume forever.
+	v.state = Attached
+}
+
+// Detach begins detaching a volume that has no more references, ahead of
+// the actual ops.Detach() call.
+func (r *RefCountsMap) Detach(name string) error {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.refCount != 0 {
+		return &BusyError{Name: name, State: v.state}
+	}
+
+	switch v.state {
+	case Attached, Detached:
+		v.state = Detaching
+		return nil
+	default:
+		return &BusyError{Name: name, State: v.state}
+	}
+}
+
+// Detached records the outcome of the ops.Detach() call started by Detach,
+// and drops the bookkeeping entry for the volume once it is idle again.
+func (r *RefCountsMap) Detached(name string, detachErr error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	v, ok := r.vols[name]
+	if !ok {
+		return
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.state != Detaching {
+		return
+	}
+	if detachErr != nil {
+		v.state = Attached
+		return
+	}
+	v.state = Detached
+	if v.refCount == 0 {
+		delete(r.vols, name)
+	}
+}
+
+// CanRemove reports whether a volume may be removed right now. Remove must
+// not run concurrently with an in-progress Attach/Mount, so it is rejected
+// while the volume is Attaching or Mounting, and whenever the refcount is
+// non-zero.
+func (r *RefCountsMap) CanRemove(name string) error {
+	v := r.getOrCreate(name)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	switch v.state {
+	case Attaching, Mounting:
+		return &BusyError{Name: name, State: v.state}
+	}
+
+	if v.refCount != 0 {
+		return fmt.Errorf("volume %s is still mounted (refcount=%d)", name, v.refCount)
+	}
+
+	switch v.state {
+	case Detached, Attached:
+		return nil
+	default:
+		return &BusyError{Name: name, State: v.state}
+	}
+}
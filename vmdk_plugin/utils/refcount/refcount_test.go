@@ -0,0 +1,208 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAttachMountUnmountDetachLifecycle(t *testing.T) {
+	r := NewRefCountsMap()
+	name := "vol1"
+
+	if _, err := r.Attach(name); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	r.Attached(name, nil)
+	if got := r.GetState(name); got != Attached {
+		t.Fatalf("state after Attached = %s, want %s", got, Attached)
+	}
+
+	if err := r.Mount(name); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	r.Mounted(name, nil)
+	if got := r.GetState(name); got != Mounted {
+		t.Fatalf("state after Mounted = %s, want %s", got, Mounted)
+	}
+
+	refcnt, doUnmount, err := r.Unmount(name)
+	if err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if refcnt != 0 || !doUnmount {
+		t.Fatalf("Unmount = (%d, %v), want (0, true)", refcnt, doUnmount)
+	}
+	r.Unmounted(name, nil)
+
+	if err := r.Detach(name); err != nil {
+		t.Fatalf("Detach: %v", err)
+	}
+	r.Detached(name, nil)
+	if got := r.GetState(name); got != Detached {
+		t.Fatalf("state after Detached = %s, want %s", got, Detached)
+	}
+}
+
+func TestAttachSecondContainerJustBumpsRefcount(t *testing.T) {
+	r := NewRefCountsMap()
+	name := "vol1"
+
+	if _, err := r.Attach(name); err != nil {
+		t.Fatalf("first Attach: %v", err)
+	}
+	r.Attached(name, nil)
+	if err := r.Mount(name); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	r.Mounted(name, nil)
+
+	refcnt, err := r.Attach(name)
+	if err != nil {
+		t.Fatalf("second Attach: %v", err)
+	}
+	if refcnt != 2 {
+		t.Fatalf("refcnt = %d, want 2", refcnt)
+	}
+
+	// First Unmount just drops the refcount; the volume is still in use.
+	refcnt, doUnmount, err := r.Unmount(name)
+	if err != nil {
+		t.Fatalf("first Unmount: %v", err)
+	}
+	if refcnt != 1 || doUnmount {
+		t.Fatalf("first Unmount = (%d, %v), want (1, false)", refcnt, doUnmount)
+	}
+
+	// Second Unmount is the last reference; now it should unmount.
+	refcnt, doUnmount, err = r.Unmount(name)
+	if err != nil {
+		t.Fatalf("second Unmount: %v", err)
+	}
+	if refcnt != 0 || !doUnmount {
+		t.Fatalf("second Unmount = (%d, %v), want (0, true)", refcnt, doUnmount)
+	}
+}
+
+func TestRemoveRejectedWhileAttaching(t *testing.T) {
+	r := NewRefCountsMap()
+	name := "vol1"
+
+	if _, err := r.Attach(name); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	// Attached() has not been called yet, so the volume is still Attaching.
+	err := r.CanRemove(name)
+	if err == nil {
+		t.Fatal("CanRemove succeeded while Attaching; want BusyError")
+	}
+	if _, ok := err.(*BusyError); !ok {
+		t.Fatalf("CanRemove error = %v (%T), want *BusyError", err, err)
+	}
+}
+
+// TestMountFailureUnwedges exercises the bug fixed in b85ff3b: a volume
+// whose Mount attempt fails partway through must fully unwind back to
+// Detached so the next Mount isn't rejected forever.
+func TestMountFailureUnwedges(t *testing.T) {
+	r := NewRefCountsMap()
+	name := "vol1"
+
+	if _, err := r.Attach(name); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	r.Attached(name, nil)
+	if err := r.Mount(name); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	// The filesystem mount itself failed.
+	r.Mounted(name, errors.New("fake mount failure"))
+	if got := r.GetState(name); got != Attached {
+		t.Fatalf("state after failed Mounted = %s, want %s", got, Attached)
+	}
+
+	// The caller's failure-cleanup path: Unmount must still say to detach
+	// even though the state never reached Mounted.
+	refcnt, doUnmount, err := r.Unmount(name)
+	if refcnt != 0 || !doUnmount {
+		t.Fatalf("Unmount after failed mount = (%d, %v, %v), want (0, true, non-nil err)", refcnt, doUnmount, err)
+	}
+	if err == nil {
+		t.Fatal("Unmount after a failed mount should report the state mismatch")
+	}
+	r.Unmounted(name, nil)
+
+	if err := r.Detach(name); err != nil {
+		t.Fatalf("Detach after unwedging: %v", err)
+	}
+	r.Detached(name, nil)
+
+	if got := r.GetState(name); got != Detached {
+		t.Fatalf("state after unwedging = %s, want %s", got, Detached)
+	}
+
+	// The volume must be usable again: a fresh Mount must not get a
+	// permanent BusyError.
+	if _, err := r.Attach(name); err != nil {
+		t.Fatalf("Attach after unwedging: %v", err)
+	}
+}
+
+func TestReconcileIsIdempotent(t *testing.T) {
+	r := NewRefCountsMap()
+	name := "vol1"
+
+	// Simulate the periodic reconciler observing the same single running
+	// container across several passes; the refcount must not balloon.
+	for i := 0; i < 3; i++ {
+		r.Reconcile(name, 1, true)
+		if got := r.GetCount(name); got != 1 {
+			t.Fatalf("pass %d: refcount = %d, want 1", i, got)
+		}
+		if got := r.GetState(name); got != Mounted {
+			t.Fatalf("pass %d: state = %s, want %s", i, got, Mounted)
+		}
+	}
+
+	// Observing zero containers brings it back to Detached.
+	r.Reconcile(name, 0, false)
+	if got := r.GetCount(name); got != 0 {
+		t.Fatalf("refcount after reconcile-to-zero = %d, want 0", got)
+	}
+	if got := r.GetState(name); got != Detached {
+		t.Fatalf("state after reconcile-to-zero = %s, want %s", got, Detached)
+	}
+}
+
+func TestGetAttachedVolumes(t *testing.T) {
+	r := NewRefCountsMap()
+
+	r.Reconcile("attached-vol", 1, false)
+	r.Reconcile("mounted-vol", 2, true)
+	r.Reconcile("idle-vol", 0, false)
+
+	got := map[string]bool{}
+	for _, name := range r.GetAttachedVolumes() {
+		got[name] = true
+	}
+	if !got["attached-vol"] || !got["mounted-vol"] {
+		t.Fatalf("GetAttachedVolumes = %v, want attached-vol and mounted-vol", got)
+	}
+	if got["idle-vol"] {
+		t.Fatalf("GetAttachedVolumes listed idle-vol, want it omitted")
+	}
+}